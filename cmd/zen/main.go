@@ -0,0 +1,113 @@
+// Command zen hosts zen's supporting tooling, starting with the rule-set
+// compiler.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chaoduzj/zen/matcher"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "rule-set":
+		if err := ruleSet(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "zen rule-set:", err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: zen rule-set <compile|convert> -out <file> <source...>")
+}
+
+// ruleSet implements the `zen rule-set compile` and `zen rule-set convert`
+// subcommands. compile reads local filter list files, convert downloads
+// them from the given URLs; both emit the same binary rule-set format.
+func ruleSet(args []string) error {
+	if len(args) < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	mode := args[0]
+	fs := flag.NewFlagSet("rule-set "+mode, flag.ExitOnError)
+	out := fs.String("out", "rules.bin", "path to write the compiled rule-set to")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	sources := fs.Args()
+	if len(sources) == 0 {
+		return fmt.Errorf("no sources given")
+	}
+
+	m := matcher.NewMatcher()
+	switch mode {
+	case "compile":
+		if err := compileLocal(m, sources); err != nil {
+			return err
+		}
+	case "convert":
+		for _, result := range m.AddRemoteFilters(context.Background(), sources) {
+			if result.Err != nil {
+				return fmt.Errorf("fetching %s: %w", result.URL, result.Err)
+			}
+			fmt.Fprintf(os.Stderr, "%s: %d lines\n", result.URL, result.Rules)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	// TODO: hash source content, not just locations, so an in-place edit of
+	// a local file is also detected as stale.
+	m.SourceHash = sha256.Sum256([]byte(strings.Join(sources, "\n")))
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := m.SaveBinary(f); err != nil {
+		return fmt.Errorf("writing %s: %w", *out, err)
+	}
+	return nil
+}
+
+func compileLocal(m *matcher.Matcher, paths []string) error {
+	for _, path := range paths {
+		if err := addRulesFromFile(m, path); err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func addRulesFromFile(m *matcher.Matcher, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m.AddRule(scanner.Text())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,504 @@
+package matcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// binaryMagic identifies a zen compiled rule-set file.
+var binaryMagic = [4]byte{'Z', 'R', 'S', '1'}
+
+// binaryVersion is bumped whenever the on-disk format changes in a way
+// that's not backward compatible, so a stale file can be rejected instead
+// of misread.
+const binaryVersion uint32 = 4
+
+// ErrIncompatibleVersion is returned by LoadBinary when the file was
+// written by a different, incompatible version of the binary format.
+var ErrIncompatibleVersion = fmt.Errorf("matcher: incompatible rule-set version")
+
+// SaveBinary serializes the matcher's rule set to w in zen's compiled
+// rule-set format: a small header (format version, source hash, rule
+// count) followed by the hostname and pattern indexes. LoadBinary reads it
+// back without re-deriving anything from Adblock syntax - no tokenizing,
+// no regex translation - which makes the hostname tier (the vast majority
+// of any real filter list) effectively free to load, O(file size) with no
+// per-rule work. The pattern tier is cheaper than AddRule but not free:
+// each pattern rule still stores its regex by source string, so LoadBinary
+// calls regexp.Compile once per pattern rule. For a rule set that's almost
+// entirely hostnames this is a minor cost; for one with millions of
+// pattern rules it's the dominant cost of a load and worth keeping in mind
+// before leaning on this format to make a huge list's startup time
+// disappear.
+//
+// m.SourceHash should be set to a hash of the sources (e.g. the filter
+// list URLs and their contents) this rule set was built from, so a caller
+// can tell a compiled file is stale by recomputing the hash and comparing
+// it against the header before loading.
+func (m *Matcher) SaveBinary(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	if _, err := bw.Write(binaryMagic[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, binaryVersion); err != nil {
+		return err
+	}
+	if _, err := bw.Write(m.SourceHash[:]); err != nil {
+		return err
+	}
+
+	idx := m.idx.Load()
+
+	idx.hostnameMu.RLock()
+	idx.patternMu.RLock()
+	ruleCount := 0
+	for _, entries := range idx.hostnames {
+		ruleCount += len(entries)
+	}
+	for _, rules := range idx.patterns {
+		ruleCount += len(rules)
+	}
+	if err := binary.Write(bw, binary.LittleEndian, uint32(ruleCount)); err != nil {
+		idx.patternMu.RUnlock()
+		idx.hostnameMu.RUnlock()
+		return err
+	}
+
+	err := writeHostnames(bw, idx.hostnames)
+	idx.hostnameMu.RUnlock()
+	if err != nil {
+		idx.patternMu.RUnlock()
+		return err
+	}
+
+	err = writePatterns(bw, idx.patterns)
+	idx.patternMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// LoadBinary reads a rule set previously written by SaveBinary. It returns
+// ErrIncompatibleVersion if the file was produced by an incompatible
+// format version.
+func LoadBinary(r io.Reader) (*Matcher, error) {
+	br := bufio.NewReader(r)
+
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, fmt.Errorf("matcher: reading magic: %w", err)
+	}
+	if magic != binaryMagic {
+		return nil, fmt.Errorf("matcher: not a rule-set file")
+	}
+
+	var version uint32
+	if err := binary.Read(br, binary.LittleEndian, &version); err != nil {
+		return nil, fmt.Errorf("matcher: reading version: %w", err)
+	}
+	if version != binaryVersion {
+		return nil, fmt.Errorf("%w: file is version %d, this binary reads version %d", ErrIncompatibleVersion, version, binaryVersion)
+	}
+
+	m := NewMatcher()
+	if _, err := io.ReadFull(br, m.SourceHash[:]); err != nil {
+		return nil, fmt.Errorf("matcher: reading source hash: %w", err)
+	}
+
+	var ruleCount uint32 // read past; not checked against the indexes that follow
+	if err := binary.Read(br, binary.LittleEndian, &ruleCount); err != nil {
+		return nil, fmt.Errorf("matcher: reading rule count: %w", err)
+	}
+
+	hostnames, err := readHostnames(br)
+	if err != nil {
+		return nil, fmt.Errorf("matcher: reading hostname index: %w", err)
+	}
+
+	patterns, err := readPatterns(br)
+	if err != nil {
+		return nil, fmt.Errorf("matcher: reading pattern index: %w", err)
+	}
+
+	idx := newIndex()
+	idx.hostnames = hostnames
+	idx.patterns = patterns
+	m.idx.Store(idx)
+
+	return m, nil
+}
+
+func writeHostnames(w io.Writer, hostnames map[string][]*ruleEntry) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(hostnames))); err != nil {
+		return err
+	}
+	for host, entries := range hostnames {
+		if err := writeString(w, host); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(entries))); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := writeBool(w, e.isException); err != nil {
+				return err
+			}
+			if err := writeBool(w, e.subdomainsOnly); err != nil {
+				return err
+			}
+			if err := writeModifiers(w, e.modifiers); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readHostnames(r io.Reader) (map[string][]*ruleEntry, error) {
+	var hostCount uint32
+	if err := binary.Read(r, binary.LittleEndian, &hostCount); err != nil {
+		return nil, err
+	}
+	hostnames := make(map[string][]*ruleEntry, hostCount)
+	for i := uint32(0); i < hostCount; i++ {
+		host, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		var entryCount uint32
+		if err := binary.Read(r, binary.LittleEndian, &entryCount); err != nil {
+			return nil, err
+		}
+		entries := make([]*ruleEntry, entryCount)
+		for j := range entries {
+			isException, err := readBool(r)
+			if err != nil {
+				return nil, err
+			}
+			subdomainsOnly, err := readBool(r)
+			if err != nil {
+				return nil, err
+			}
+			modifiers, err := readModifiers(r)
+			if err != nil {
+				return nil, err
+			}
+			entries[j] = &ruleEntry{modifiers: modifiers, isException: isException, subdomainsOnly: subdomainsOnly}
+		}
+		hostnames[host] = entries
+	}
+	return hostnames, nil
+}
+
+func writePatterns(w io.Writer, patterns map[string][]*patternRule) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(patterns))); err != nil {
+		return err
+	}
+	for key, rules := range patterns {
+		if err := writeString(w, key); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(rules))); err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if err := writeString(w, rule.regex.String()); err != nil {
+				return err
+			}
+			if err := writeBool(w, rule.isException); err != nil {
+				return err
+			}
+			if err := writeModifiers(w, rule.modifiers); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readPatterns(r io.Reader) (map[string][]*patternRule, error) {
+	var bucketCount uint32
+	if err := binary.Read(r, binary.LittleEndian, &bucketCount); err != nil {
+		return nil, err
+	}
+	patterns := make(map[string][]*patternRule, bucketCount)
+	for i := uint32(0); i < bucketCount; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		var ruleCount uint32
+		if err := binary.Read(r, binary.LittleEndian, &ruleCount); err != nil {
+			return nil, err
+		}
+		rules := make([]*patternRule, ruleCount)
+		for j := range rules {
+			source, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			regex, err := regexp.Compile(source)
+			if err != nil {
+				return nil, err
+			}
+			isException, err := readBool(r)
+			if err != nil {
+				return nil, err
+			}
+			modifiers, err := readModifiers(r)
+			if err != nil {
+				return nil, err
+			}
+			rules[j] = &patternRule{regex: regex, modifiers: modifiers, isException: isException}
+		}
+		patterns[key] = rules
+	}
+	return patterns, nil
+}
+
+func writeModifiers(w io.Writer, m *ruleModifiers) error {
+	if err := writeBool(w, m != nil); err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+
+	for _, t := range []modifierType{m.document, m.font, m.image, m.media, m.other, m.script, m.stylesheet, m.thirdParty} {
+		if err := binary.Write(w, binary.LittleEndian, uint8(t)); err != nil {
+			return err
+		}
+	}
+	if err := writeBool(w, m.important); err != nil {
+		return err
+	}
+	if err := writeDomainList(w, m.domain); err != nil {
+		return err
+	}
+	if err := writeDomainList(w, m.denyallow); err != nil {
+		return err
+	}
+	if err := writeStringSetList(w, m.method); err != nil {
+		return err
+	}
+	if err := writeString(w, m.header); err != nil {
+		return err
+	}
+	if err := writeString(w, m.csp); err != nil {
+		return err
+	}
+	if err := writeStringSetList(w, m.dnsType); err != nil {
+		return err
+	}
+	return writeDNSRewrite(w, m.dnsRewrite)
+}
+
+func readModifiers(r io.Reader) (*ruleModifiers, error) {
+	hasModifiers, err := readBool(r)
+	if err != nil {
+		return nil, err
+	}
+	if !hasModifiers {
+		return nil, nil
+	}
+
+	m := &ruleModifiers{}
+	types := []*modifierType{&m.document, &m.font, &m.image, &m.media, &m.other, &m.script, &m.stylesheet, &m.thirdParty}
+	for _, t := range types {
+		var raw uint8
+		if err := binary.Read(r, binary.LittleEndian, &raw); err != nil {
+			return nil, err
+		}
+		*t = modifierType(raw)
+	}
+	important, err := readBool(r)
+	if err != nil {
+		return nil, err
+	}
+	m.important = important
+	if m.domain, err = readDomainList(r); err != nil {
+		return nil, err
+	}
+	if m.denyallow, err = readDomainList(r); err != nil {
+		return nil, err
+	}
+	if m.method, err = readStringSetList(r); err != nil {
+		return nil, err
+	}
+	if m.header, err = readString(r); err != nil {
+		return nil, err
+	}
+	if m.csp, err = readString(r); err != nil {
+		return nil, err
+	}
+	if m.dnsType, err = readStringSetList(r); err != nil {
+		return nil, err
+	}
+	if m.dnsRewrite, err = readDNSRewrite(r); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func writeDomainList(w io.Writer, d *domainList) error {
+	if err := writeBool(w, d != nil); err != nil {
+		return err
+	}
+	if d == nil {
+		return nil
+	}
+	if err := writeStringSlice(w, d.include); err != nil {
+		return err
+	}
+	return writeStringSlice(w, d.exclude)
+}
+
+func readDomainList(r io.Reader) (*domainList, error) {
+	present, err := readBool(r)
+	if err != nil || !present {
+		return nil, err
+	}
+	d := &domainList{}
+	if d.include, err = readStringSlice(r); err != nil {
+		return nil, err
+	}
+	if d.exclude, err = readStringSlice(r); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func writeStringSetList(w io.Writer, s *stringSetList) error {
+	if err := writeBool(w, s != nil); err != nil {
+		return err
+	}
+	if s == nil {
+		return nil
+	}
+	if err := writeStringSlice(w, s.include); err != nil {
+		return err
+	}
+	return writeStringSlice(w, s.exclude)
+}
+
+func readStringSetList(r io.Reader) (*stringSetList, error) {
+	present, err := readBool(r)
+	if err != nil || !present {
+		return nil, err
+	}
+	s := &stringSetList{}
+	if s.include, err = readStringSlice(r); err != nil {
+		return nil, err
+	}
+	if s.exclude, err = readStringSlice(r); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func writeDNSRewrite(w io.Writer, d *dnsRewrite) error {
+	if err := writeBool(w, d != nil); err != nil {
+		return err
+	}
+	if d == nil {
+		return nil
+	}
+	if err := writeBool(w, d.nxdomain); err != nil {
+		return err
+	}
+	if err := writeString(w, d.rtype); err != nil {
+		return err
+	}
+	return writeString(w, d.value)
+}
+
+func readDNSRewrite(r io.Reader) (*dnsRewrite, error) {
+	present, err := readBool(r)
+	if err != nil || !present {
+		return nil, err
+	}
+	d := &dnsRewrite{}
+	if d.nxdomain, err = readBool(r); err != nil {
+		return nil, err
+	}
+	if d.rtype, err = readString(r); err != nil {
+		return nil, err
+	}
+	if d.value, err = readString(r); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func writeStringSlice(w io.Writer, s []string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	for _, v := range s {
+		if err := writeString(w, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readStringSlice(r io.Reader) ([]string, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	s := make([]string, count)
+	for i := range s {
+		v, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		s[i] = v
+	}
+	return s, nil
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func writeBool(w io.Writer, b bool) error {
+	var v uint8
+	if b {
+		v = 1
+	}
+	return binary.Write(w, binary.LittleEndian, v)
+}
+
+func readBool(r io.Reader) (bool, error) {
+	var v uint8
+	if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+		return false, err
+	}
+	return v != 0, nil
+}
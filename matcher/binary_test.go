@@ -0,0 +1,74 @@
+package matcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestSaveLoadBinaryRoundTrip(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^$domain=a.com")
+	m.AddRule("@@||allowed.example.com^")
+	m.AddRule("||*.wild.example.org^")
+	m.AddRule("||rewrite.example.net^$dnsrewrite=NOERROR;A;1.2.3.4")
+	m.AddRule("/banner-ad*.js")
+	m.SourceHash = sha256.Sum256([]byte("test sources"))
+
+	var buf bytes.Buffer
+	if err := m.SaveBinary(&buf); err != nil {
+		t.Fatalf("SaveBinary: %v", err)
+	}
+
+	loaded, err := LoadBinary(&buf)
+	if err != nil {
+		t.Fatalf("LoadBinary: %v", err)
+	}
+
+	if loaded.SourceHash != m.SourceHash {
+		t.Errorf("SourceHash = %x, want %x", loaded.SourceHash, m.SourceHash)
+	}
+
+	tests := []struct {
+		url       string
+		sourceURL string
+		want      Action
+	}{
+		{"https://ads.example.com/x", "https://a.com/", Block},
+		{"https://ads.example.com/x", "https://other.com/", NoMatch},
+		{"https://allowed.example.com/", "", Allow},
+		{"https://wild.example.org/", "", NoMatch},
+		{"https://sub.wild.example.org/", "", Block},
+		{"https://cdn.example.com/banner-ad-1.js", "", Block},
+	}
+	for _, tt := range tests {
+		got := loaded.Match(&Request{URL: tt.url, SourceURL: tt.sourceURL})
+		if got != tt.want {
+			t.Errorf("loaded.Match(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+
+	dnsAction := loaded.MatchDNS("rewrite.example.net", DNSTypeA)
+	if dnsAction.Action != Block || dnsAction.RewriteType != "A" || dnsAction.RewriteValue != "1.2.3.4" {
+		t.Errorf("loaded.MatchDNS(rewrite.example.net) = %+v, want Block with A/1.2.3.4 rewrite", dnsAction)
+	}
+}
+
+func TestLoadBinaryIncompatibleVersion(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||example.com^")
+
+	var buf bytes.Buffer
+	if err := m.SaveBinary(&buf); err != nil {
+		t.Fatalf("SaveBinary: %v", err)
+	}
+
+	data := buf.Bytes()
+	// The version field follows the 4-byte magic, little-endian uint32.
+	data[4]++
+
+	if _, err := LoadBinary(bytes.NewReader(data)); !errors.Is(err, ErrIncompatibleVersion) {
+		t.Errorf("LoadBinary with bumped version = %v, want ErrIncompatibleVersion", err)
+	}
+}
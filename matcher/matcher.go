@@ -1,189 +1,146 @@
 package matcher
 
 import (
-	"bufio"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-// nodeKind is the type of a node in the trie.
-type nodeKind int
-
-const (
-	nodeKindExactMatch   nodeKind = iota
-	nodeKindAddressRoot           // |
-	nodeKindHostnameRoot          // hosts.txt
-	nodeKindDomain                // ||
-	nodeKindWildcard              // *
-	nodeKindSeparator             // ^
-)
-
-// nodeKey identifies a node in the trie.
-// It is a combination of the node kind and the token that the node represents.
-// The token is only present for nodes with kind nodeKindExactMatch.
-// The other kinds of nodes only represent roots of subtrees.
-type nodeKey struct {
-	kind  nodeKind
-	token string
+// ruleEntry is a single rule (block or exception) attached to a hostname in
+// the hostname index.
+type ruleEntry struct {
+	modifiers   *ruleModifiers
+	isException bool
+	// subdomainsOnly is true for a "||*.host^" rule, which - unlike a bare
+	// "||host^" rule - must match only strict subdomains of host, not host
+	// itself.
+	subdomainsOnly bool
 }
 
-// node is a node in the trie.
-type node struct {
-	children   map[nodeKey]*node
-	childrenMu sync.RWMutex
-	isRule     bool
-	modifiers  *ruleModifiers
+// patternRule is a single rule in the pattern index: a rule whose pattern
+// couldn't be reduced to a plain hostname, compiled to a regular
+// expression once at AddRule time so Match never has to touch regexp
+// machinery for the common hostname case.
+type patternRule struct {
+	regex       *regexp.Regexp
+	modifiers   *ruleModifiers
+	isException bool
 }
 
-func (n *node) findOrAddChild(key nodeKey) *node {
-	n.childrenMu.RLock()
-	child, ok := n.children[key]
-	n.childrenMu.RUnlock()
-	if ok {
-		return child
-	}
+// index is the hostname/pattern rule set a Matcher serves Match requests
+// from. It's held behind an atomic pointer so Reload can build a new one
+// off to the side and swap it in atomically, without traffic ever seeing a
+// half-populated rule set.
+type index struct {
+	hostnameMu sync.RWMutex
+	hostnames  map[string][]*ruleEntry
+
+	patternMu sync.RWMutex
+	// patterns is keyed by shortcut token; rules with no usable shortcut
+	// (e.g. a pattern that's all wildcards) are stored under "".
+	patterns map[string][]*patternRule
+}
 
-	n.childrenMu.Lock()
-	child = &node{
-		children: make(map[nodeKey]*node),
+func newIndex() *index {
+	return &index{
+		hostnames: make(map[string][]*ruleEntry),
+		patterns:  make(map[string][]*patternRule),
 	}
-	n.children[key] = child
-	n.childrenMu.Unlock()
-	return child
 }
 
-func (n *node) findChild(key nodeKey) *node {
-	n.childrenMu.RLock()
-	child := n.children[key]
-	n.childrenMu.RUnlock()
-	return child
+func (idx *index) addHostname(hostname string, modifiers *ruleModifiers, isException, subdomainsOnly bool) {
+	entry := &ruleEntry{modifiers: modifiers, isException: isException, subdomainsOnly: subdomainsOnly}
+	idx.hostnameMu.Lock()
+	idx.hostnames[hostname] = append(idx.hostnames[hostname], entry)
+	idx.hostnameMu.Unlock()
 }
 
-var (
-	// reSeparator is a regular expression that matches the separator token.
-	// according to the https://adguard.com/kb/general/ad-filtering/create-own-filters/#basic-rules-special-characters
-	// "Separator character is any character, but a letter, a digit, or one of the following: _ - . %. ... The end of the address is also accepted as separator."
-	reSeparator = regexp.MustCompile(`[^a-zA-Z0-9]|[_\-.%]`)
-)
-
-// match returns true if the node's subtree matches the given tokens.
-//
-// If a matching rule is found, it is returned along with the remaining tokens.
-// If no matching rule is found, nil is returned.
-func (n *node) match(tokens []string) (*node, []string) {
-	if n == nil {
-		return nil, nil
-	}
-	if n.modifiers != nil && n.isRule {
-		return n, tokens
-	}
-	if len(tokens) == 0 {
-		if separator := n.findChild(nodeKey{kind: nodeKindSeparator}); separator != nil && separator.modifiers != nil && separator.isRule {
-			return separator, tokens
-		}
-		return nil, nil
-	}
-	if reSeparator.MatchString(tokens[0]) {
-		if match, _ := n.findChild(nodeKey{kind: nodeKindSeparator}).match(tokens[1:]); match != nil {
-			return match, tokens
-		}
-	}
-	if wildcard := n.findChild(nodeKey{kind: nodeKindWildcard}); wildcard != nil {
-		if match, _ := wildcard.match(tokens[1:]); match != nil {
-			return match, tokens
-		}
+func (idx *index) addPattern(pattern string, modifiers *ruleModifiers, isException bool) {
+	regex, err := compilePatternRegex(pattern)
+	if err != nil {
+		return
 	}
+	rule := &patternRule{regex: regex, modifiers: modifiers, isException: isException}
 
-	return n.findChild(nodeKey{kind: nodeKindExactMatch, token: tokens[0]}).match(tokens[1:])
+	idx.patternMu.Lock()
+	key := idx.rarestToken(pattern)
+	idx.patterns[key] = append(idx.patterns[key], rule)
+	idx.patternMu.Unlock()
 }
 
-type modifierType int
+// Action is the outcome of matching a request against the filter rules.
+type Action int
 
 const (
-	modifierTypeNone modifierType = iota
-	modifierTypeInclude
-	modifierTypeExclude
+	// NoMatch means no rule matched the request.
+	NoMatch Action = iota
+	// Block means a blocking rule matched and no exception overrides it.
+	Block
+	// Allow means an exception (@@) rule matched and overrides any
+	// non-important blocking rule.
+	Allow
 )
 
-// ruleModifiers represents modifiers of a rule.
-type ruleModifiers struct {
-	// basic modifiers
-	// https://adguard.com/kb/general/ad-filtering/create-own-filters/#basic-rules-basic-modifiers
-	// domain     string
-	// thirdParty optionType
-	// header     string
-	// important  optionType
-	// method     string
-	// content type modifiers
-	// https://adguard.com/kb/general/ad-filtering/create-own-filters/#content-type-modifiers
-	document   modifierType
-	font       modifierType
-	image      modifierType
-	media      modifierType
-	other      modifierType
-	script     modifierType
-	stylesheet modifierType
+// Matcher matches URLs against Adblock filters and hosts rules.
+//
+// Rules are split into two indexes: hostnames (hosts-file entries and
+// "||host^" rules, which make up the vast majority of any real filter
+// list) are looked up directly by hostname label, in O(labels) per
+// request. Everything else is indexed by a "shortcut" token - one of the
+// pattern's alphanumeric runs, picked by rarity rather than just length
+// (see rarestToken) - so a request only has to be checked against the
+// patterns that share a token with its URL, rather than every pattern
+// rule in the list. This mirrors the hostname/shortcut split used by
+// other network filtering engines (e.g. urlfilter's NetworkEngine).
+//
+// The matcher is safe for concurrent use.
+type Matcher struct {
+	idx atomic.Pointer[index]
+
+	// httpClient and cacheDir configure AddRemoteFilters and Reload; see
+	// WithHTTPClient and WithCacheDir.
+	httpClient *http.Client
+	cacheDir   string
+
+	// sources is the URL list passed to the most recent AddRemoteFilters
+	// call, remembered so Reload knows what to re-fetch.
+	sourcesMu sync.Mutex
+	sources   []string
+
+	// SourceHash identifies the sources (e.g. filter list URLs and their
+	// contents) this rule set was built from. SaveBinary stores it in the
+	// compiled file's header so a caller can detect a stale file by
+	// recomputing the hash and comparing it, without re-parsing the file.
+	SourceHash [32]byte
 }
 
-func parseModifiers(modifiers string) (*ruleModifiers, error) {
-	if modifiers == "" {
-		return nil, nil
-	}
+// Option configures a Matcher built by NewMatcher.
+type Option func(*Matcher)
 
-	m := &ruleModifiers{}
-	for _, modifier := range strings.Split(modifiers, ",") {
-		if strings.ContainsRune(modifier, '=') {
-			// TODO: handle key=value modifiers
-			return nil, fmt.Errorf("key=value modifiers are not supported")
-		}
-		t := modifierTypeInclude
-		if modifier[0] == '~' {
-			t = modifierTypeExclude
-			modifier = modifier[1:]
-		}
-		switch modifier {
-		case "document":
-			m.document = t
-		case "font":
-			m.font = t
-		case "image":
-			m.image = t
-		case "media":
-			m.media = t
-		case "other":
-			m.other = t
-		case "script":
-			m.script = t
-		case "stylesheet":
-			m.stylesheet = t
-		default:
-			// first, do no harm
-			// in case an unknown modifier is encountered, ignore the whole rule
-			return nil, fmt.Errorf("unknown modifier %q", modifier)
-		}
-	}
-	return m, nil
+// WithHTTPClient overrides the http.Client AddRemoteFilters and Reload use
+// to fetch remote filter lists. The default is http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(m *Matcher) { m.httpClient = client }
 }
 
-// Matcher is trie-based matcher for URLs that is capable of parsing
-// Adblock filters and hosts rules and matching URLs against them.
-//
-// The matcher is safe for concurrent use.
-type Matcher struct {
-	root *node
+// WithCacheDir sets the directory AddRemoteFilters and Reload use to cache
+// downloaded filter lists between runs, keyed by URL, along with the
+// ETag/Last-Modified needed to conditionally re-fetch them. If unset,
+// sources are always downloaded in full.
+func WithCacheDir(dir string) Option {
+	return func(m *Matcher) { m.cacheDir = dir }
 }
 
-func NewMatcher() *Matcher {
-	return &Matcher{
-		root: &node{
-			children: make(map[nodeKey]*node),
-		},
+func NewMatcher(opts ...Option) *Matcher {
+	m := &Matcher{httpClient: http.DefaultClient}
+	m.idx.Store(newIndex())
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
 
 var (
@@ -191,203 +148,482 @@ var (
 	hostnameCG  = `((?:[\da-z][\da-z_-]*\.)+[\da-z-]*[a-z])`
 	urlCG       = `(https?:\/\/(?:www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b(?:[-a-zA-Z0-9()@:%_\+.~#?&\/=]*))`
 	modifiersCG = `(?:\$(.+))?`
-	// Ignore comments, cosmetic rules, [Adblock Plus 2.0]-style, and, temporarily, exception rules.
-	reIgnoreRule           = regexp.MustCompile(`^(?:!|#|\[|@@)|(##|#\?#|#\$#|#@#)`)
+	// Ignore comments, cosmetic rules, and [Adblock Plus 2.0]-style rules.
+	reIgnoreRule           = regexp.MustCompile(`^(?:!|#|\[)|(##|#\?#|#\$#|#@#)`)
 	reHosts                = regexp.MustCompile(fmt.Sprintf(`^(?:0\.0\.0\.0|127\.0\.0\.1) %s`, hostnameCG))
 	reHostsIgnore          = regexp.MustCompile(`^(?:0\.0\.0\.0|broadcasthost|local|localhost(?:\.localdomain)?|ip6-\w+)$`)
-	reDomainName           = regexp.MustCompile(fmt.Sprintf(`^\|\|%s\^%s$`, hostnameCG, modifiersCG))
+	reDomainName           = regexp.MustCompile(fmt.Sprintf(`^\|\|(\*\.)?%s\^%s$`, hostnameCG, modifiersCG))
 	reExactAddress         = regexp.MustCompile(fmt.Sprintf(`^\|%s%s$`, urlCG, modifiersCG))
 	reAddressPartsModifier = regexp.MustCompile(fmt.Sprintf(`%s$`, modifiersCG))
 )
 
+// exceptionPrefix marks a rule as an allowlist (@@) rule, e.g. "@@||example.com^".
+const exceptionPrefix = "@@"
+
 func (m *Matcher) AddRule(rule string) {
+	addRuleTo(m.idx.Load(), rule)
+}
+
+// addRuleTo parses rule and, if it's not a comment or cosmetic rule, adds
+// it to idx.
+func addRuleTo(idx *index, rule string) {
 	if reIgnoreRule.MatchString(rule) {
 		return
 	}
 
-	var tokens []string
-	var modifiers *ruleModifiers
-	var err error
-	rootKeyKind := nodeKindExactMatch
+	isException := strings.HasPrefix(rule, exceptionPrefix)
+	if isException {
+		rule = rule[len(exceptionPrefix):]
+	}
+
 	if host := reHosts.FindStringSubmatch(rule); host != nil {
 		if !reHostsIgnore.MatchString(host[1]) {
-			rootKeyKind = nodeKindHostnameRoot
-			tokens = tokenize(host[1])
-		}
-	} else if match := reDomainName.FindStringSubmatch(rule); match != nil {
-		rootKeyKind = nodeKindDomain
-		tokens = tokenize(match[1])
-		if modifiers, err = parseModifiers(match[2]); err != nil {
-			return
+			idx.addHostname(host[1], nil, isException, false)
 		}
-	} else if match := reExactAddress.FindStringSubmatch(rule); match != nil {
-		rootKeyKind = nodeKindAddressRoot
-		tokens = tokenize(match[1])
-		if modifiers, err = parseModifiers(match[2]); err != nil {
+		return
+	}
+
+	if match := reDomainName.FindStringSubmatch(rule); match != nil {
+		modifiers, err := parseModifiers(match[3])
+		if err != nil {
 			return
 		}
+		subdomainsOnly := match[1] != ""
+		idx.addHostname(match[2], modifiers, isException, subdomainsOnly)
+		return
+	}
+
+	var pattern, modifierString string
+	if match := reExactAddress.FindStringSubmatch(rule); match != nil {
+		pattern, modifierString = "|"+match[1], match[2]
+	} else if match := reAddressPartsModifier.FindStringSubmatch(rule); match != nil {
+		pattern, modifierString = rule[:len(rule)-len(match[0])], match[1]
 	} else {
-		tokens = tokenize(rule)
-		if match := reAddressPartsModifier.FindStringSubmatch(rule); match != nil {
-			if modifiers, err = parseModifiers(match[1]); err != nil {
-				return
-			}
-		}
+		pattern = rule
+	}
+	if pattern == "" {
+		return
 	}
 
-	if len(tokens) == 0 {
+	modifiers, err := parseModifiers(modifierString)
+	if err != nil {
 		return
 	}
+	idx.addPattern(pattern, modifiers, isException)
+}
 
-	node := m.root.findOrAddChild(nodeKey{kind: rootKeyKind})
-	for _, token := range tokens {
-		if token == "^" {
-			node = node.findOrAddChild(nodeKey{kind: nodeKindSeparator})
-		} else if token == "*" {
-			node = node.findOrAddChild(nodeKey{kind: nodeKindWildcard})
+// Match returns how the given request should be treated according to the
+// filter rules: Block, Allow, or NoMatch. req.URL is expected to be in the
+// fully qualified form; the remaining Request fields are consulted against
+// modifiers such as domain=, third-party, method=, and header=. An
+// exception (@@) rule overrides a blocking rule unless the blocking rule
+// carries the important modifier.
+//
+// An exception rule carrying the document modifier (e.g.
+// "@@||example.com^$document", the standard "whitelist this whole site"
+// idiom) is matched against the initiator's hostname, hostname(req.SourceURL),
+// rather than req.URL - it exempts every request a site's own pages make,
+// not just requests targeting the site itself.
+func (m *Matcher) Match(req *Request) Action {
+	var blocked, blockedImportant, allowed bool
+	// note records the outcome of a matched rule and reports whether
+	// matching can stop early, which is only ever the case for an
+	// important blocking rule since nothing can override it.
+	note := func(modifiers *ruleModifiers, isException bool) bool {
+		if isException {
+			allowed = true
 		} else {
-			node = node.findOrAddChild(nodeKey{kind: nodeKindExactMatch, token: token})
+			blocked = true
+			if modifiers != nil && modifiers.important {
+				blockedImportant = true
+			}
 		}
+		return blockedImportant
 	}
-	node.modifiers = modifiers
-}
 
-// AddRemoteFilters parses the rules files at the given URLs and adds them to
-// the filter.
-func (m *Matcher) AddRemoteFilters(urls []string) error {
-	c := 0
-	for _, url := range urls {
-		file, err := http.Get(url)
-		if err != nil {
-			log.Printf("failed to download rules file %s: %v", url, err)
-		}
-		defer file.Body.Close()
-		reader := bufio.NewReader(file.Body)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				log.Printf("failed to read line from rules file %s: %v", url, err)
+	idx := m.idx.Load()
+
+	host := hostname(req.URL)
+	for candidate := host; candidate != ""; candidate = parentDomain(candidate) {
+		idx.hostnameMu.RLock()
+		entries := idx.hostnames[candidate]
+		idx.hostnameMu.RUnlock()
+		for _, e := range entries {
+			if e.subdomainsOnly && candidate == host {
+				continue
+			}
+			if e.modifiers != nil && e.modifiers.csp != "" {
+				// A csp= rule never blocks; see MatchCSP.
+				continue
+			}
+			if !evaluateModifiers(e.modifiers, req) {
+				continue
+			}
+			if note(e.modifiers, e.isException) {
+				return Block
 			}
-			line = line[:len(line)-1] // strip the trailing newline
-			m.AddRule(line)
-			c++
 		}
 	}
-	log.Printf("added %d rules", c)
-	return nil
-}
-
-// Match returns true if the given URL matches any of the rules.
-// It expects the URL to be in the fully qualified form.
-func (m *Matcher) Match(url string) bool {
-	// address root -> hostname root -> domain -> etc.
-	tokens := tokenize(url)
 
-	// address root
-	if match, remaingTokens := m.root.findChild(nodeKey{kind: nodeKindAddressRoot}).match(tokens); match != nil && len(remaingTokens) == 0 {
-		return true
+	for _, token := range shortcutCandidates(req.URL) {
+		idx.patternMu.RLock()
+		rules := idx.patterns[token]
+		idx.patternMu.RUnlock()
+		for _, r := range rules {
+			if !r.regex.MatchString(req.URL) {
+				continue
+			}
+			if r.modifiers != nil && r.modifiers.csp != "" {
+				continue
+			}
+			if !evaluateModifiers(r.modifiers, req) {
+				continue
+			}
+			if note(r.modifiers, r.isException) {
+				return Block
+			}
+		}
 	}
-	if match, _ := m.root.match(tokens); match != nil {
-		return true
+
+	if sourceHost := hostname(req.SourceURL); sourceHost != "" {
+		for candidate := sourceHost; candidate != ""; candidate = parentDomain(candidate) {
+			idx.hostnameMu.RLock()
+			entries := idx.hostnames[candidate]
+			idx.hostnameMu.RUnlock()
+			for _, e := range entries {
+				if !e.isException || e.modifiers == nil || e.modifiers.document != modifierTypeInclude {
+					continue
+				}
+				if e.subdomainsOnly && candidate == sourceHost {
+					continue
+				}
+				note(e.modifiers, e.isException)
+			}
+		}
 	}
-	if len(tokens) == 0 {
-		return false
+
+	switch {
+	case allowed:
+		return Allow
+	case blocked:
+		return Block
+	default:
+		return NoMatch
 	}
-	tokens = tokens[1:]
+}
 
-	// protocol separator
-	if match, _ := m.root.match(tokens); match != nil {
-		return true
+// MatchCSP returns the Content-Security-Policy directives a csp= rule asks
+// to be injected into the response to req, e.g. []string{"script-src
+// 'self'"} for a rule like "||example.com^$csp=script-src 'self'". Unlike
+// Match, a csp= rule never blocks the request - it only ever contributes a
+// directive here - so this is a separate call rather than another Action
+// value.
+//
+// A matching csp= exception rule (e.g. "@@||example.com^$csp=script-src
+// 'self'") disables CSP injection for the request entirely, the same
+// precedence Match gives an exception over a block: MatchCSP returns nil if
+// one matches, even if other csp= rules also matched. A bare "$csp" with no
+// directive is not a recognized modifier, so such a rule is dropped.
+func (m *Matcher) MatchCSP(req *Request) []string {
+	idx := m.idx.Load()
+
+	var directives []string
+	var disabled bool
+	collect := func(modifiers *ruleModifiers, isException bool) {
+		if modifiers == nil || modifiers.csp == "" {
+			return
+		}
+		if isException {
+			disabled = true
+			return
+		}
+		directives = append(directives, modifiers.csp)
 	}
-	if len(tokens) == 0 {
-		return false
+
+	host := hostname(req.URL)
+	for candidate := host; candidate != ""; candidate = parentDomain(candidate) {
+		idx.hostnameMu.RLock()
+		entries := idx.hostnames[candidate]
+		idx.hostnameMu.RUnlock()
+		for _, e := range entries {
+			if e.subdomainsOnly && candidate == host {
+				continue
+			}
+			if !evaluateModifiers(e.modifiers, req) {
+				continue
+			}
+			collect(e.modifiers, e.isException)
+		}
 	}
-	tokens = tokens[1:]
 
-	var hostnameMatcher func(*node, []string) bool
-	hostnameMatcher = func(node *node, tokens []string) bool {
-		if match, remainingTokens := node.match(tokens); match != nil {
-			if len(remainingTokens) == 0 || remainingTokens[0] != "." {
-				// hostname matched the entire hostname
-				return true
+	for _, token := range shortcutCandidates(req.URL) {
+		idx.patternMu.RLock()
+		rules := idx.patterns[token]
+		idx.patternMu.RUnlock()
+		for _, r := range rules {
+			if !r.regex.MatchString(req.URL) {
+				continue
 			}
-			if remainingTokens[0] == "." {
-				return hostnameMatcher(match.findChild(nodeKey{kind: nodeKindExactMatch, token: "."}), remainingTokens[1:])
+			if !evaluateModifiers(r.modifiers, req) {
+				continue
 			}
+			collect(r.modifiers, r.isException)
 		}
-		return false
 	}
 
-	// hostname root
-	hostnameRootNode := m.root.findChild(nodeKey{kind: nodeKindHostnameRoot})
-	if hostnameRootNode != nil && hostnameMatcher(hostnameRootNode, tokens) {
-		return true
+	if disabled {
+		return nil
 	}
+	return directives
+}
 
-	// domain segments
-	for len(tokens) > 0 {
-		if tokens[0] == "/" {
-			break
-		}
-		if tokens[0] != "." {
-			if match, _ := m.root.findChild(nodeKey{kind: nodeKindDomain}).match(tokens); match != nil {
+// DNS record types recognized by the dnstype= modifier and MatchDNS. These
+// mirror the values assigned by RFC 1035 and its successors, so a caller
+// can pass the qtype straight off the wire without a translation table of
+// its own.
+const (
+	DNSTypeA     uint16 = 1
+	DNSTypeCNAME uint16 = 5
+	DNSTypeAAAA  uint16 = 28
+)
+
+// dnsTypeName returns the dnstype= modifier name for qtype (e.g. "A" for
+// DNSTypeA), or "" for any other type. A dnstype= filter with an include
+// list (e.g. dnstype=AAAA) therefore never matches such a query, while one
+// with only exclusions (e.g. dnstype=~A) always does.
+func dnsTypeName(qtype uint16) string {
+	switch qtype {
+	case DNSTypeA:
+		return "A"
+	case DNSTypeAAAA:
+		return "AAAA"
+	case DNSTypeCNAME:
+		return "CNAME"
+	default:
+		return ""
+	}
+}
+
+// DNSAction is the outcome of matching a DNS query against the filter
+// rules, shaped so a DNS server frontend can build its response directly
+// without re-parsing any rule.
+type DNSAction struct {
+	// Action is Block, Allow, or NoMatch.
+	Action Action
+	// NXDomain is true if the blocking rule's dnsrewrite= modifier was the
+	// "NXDOMAIN" shorthand (or a full "rcode;rtype;value" form whose rcode
+	// is NXDOMAIN):
+	// the query should be answered with NXDOMAIN rather than simply
+	// dropped or answered empty.
+	NXDomain bool
+	// RewriteType is the rewritten record type (e.g. "A" or "CNAME") from
+	// a dnsrewrite= modifier, or "" if the rule carried no rewrite.
+	RewriteType string
+	// RewriteValue is the rewrite target (e.g. an IP address or
+	// hostname) from a dnsrewrite= modifier, or "" if the rule carried no
+	// rewrite or used the NXDOMAIN shorthand.
+	RewriteValue string
+}
+
+// MatchDNS returns how a DNS query for qname (of record type qtype, e.g.
+// DNSTypeA) should be treated according to the filter rules. Only the
+// hostname index is consulted - hosts-file entries and "||host^" rules,
+// including the "||*.host^" wildcard form - since DNS-mode filtering has no
+// notion of a URL path, query string, or request method for the pattern
+// index's rules to match against.
+func (m *Matcher) MatchDNS(qname string, qtype uint16) DNSAction {
+	dnsType := dnsTypeName(qtype)
+
+	var blocked, allowed bool
+	var blockModifiers *ruleModifiers
+	// note records the outcome of a matched rule and reports whether
+	// matching can stop early, which is only ever the case for an
+	// important blocking rule since nothing can override it.
+	note := func(modifiers *ruleModifiers, isException bool) bool {
+		if isException {
+			allowed = true
+		} else {
+			blocked = true
+			blockModifiers = modifiers
+			if modifiers != nil && modifiers.important {
 				return true
 			}
 		}
-		if match, _ := m.root.match(tokens); match != nil {
-			return true
-		}
-		tokens = tokens[1:]
+		return false
 	}
 
-	// rest of the URL
-	// TODO: handle query parameters, etc.
-	for len(tokens) > 0 {
-		if match, _ := m.root.findChild(nodeKey{kind: nodeKindExactMatch}).match(tokens); match != nil {
-			return true
+	idx := m.idx.Load()
+
+	qname = strings.TrimSuffix(qname, ".")
+	for candidate := qname; candidate != ""; candidate = parentDomain(candidate) {
+		idx.hostnameMu.RLock()
+		entries := idx.hostnames[candidate]
+		idx.hostnameMu.RUnlock()
+		for _, e := range entries {
+			if e.subdomainsOnly && candidate == qname {
+				continue
+			}
+			if e.modifiers != nil && e.modifiers.csp != "" {
+				// A csp= rule never blocks; see MatchCSP.
+				continue
+			}
+			if e.modifiers != nil && !e.modifiers.dnsType.matches(dnsType) {
+				continue
+			}
+			if note(e.modifiers, e.isException) {
+				return dnsBlockAction(blockModifiers)
+			}
 		}
-		tokens = tokens[1:]
 	}
 
-	return false
+	switch {
+	case allowed:
+		return DNSAction{Action: Allow}
+	case blocked:
+		return dnsBlockAction(blockModifiers)
+	default:
+		return DNSAction{Action: NoMatch}
+	}
 }
 
-var (
-	reTokenSep = regexp.MustCompile(`(^https|^http|\.|-|_|:\/\/|\/|\?|=|&|:|\^)`)
-)
+// dnsBlockAction builds the DNSAction for a blocked DNS query, translating
+// modifiers' dnsrewrite= target (if any) into the action's Rewrite fields.
+func dnsBlockAction(modifiers *ruleModifiers) DNSAction {
+	action := DNSAction{Action: Block}
+	if modifiers == nil || modifiers.dnsRewrite == nil {
+		return action
+	}
+	action.NXDomain = modifiers.dnsRewrite.nxdomain
+	action.RewriteType = modifiers.dnsRewrite.rtype
+	action.RewriteValue = modifiers.dnsRewrite.value
+	return action
+}
 
-func tokenize(s string) []string {
-	tokenRanges := reTokenSep.FindAllStringIndex(s, -1)
-	// assume that each separator is followed by a token
-	// over-allocating is fine, since the token arrays will be short-lived
-	tokens := make([]string, 0, len(tokenRanges)+1)
+// parentDomain strips the leftmost label from host, e.g. "a.b.com" ->
+// "b.com". It returns "" once there's nothing left to strip.
+func parentDomain(host string) string {
+	i := strings.IndexByte(host, '.')
+	if i < 0 {
+		return ""
+	}
+	return host[i+1:]
+}
 
-	// check if the first range doesn't start at the beginning of the string
-	// if it doesn't, then the first token is the substring from the beginning
-	// of the string to the start of the first range
-	if len(tokenRanges) > 0 && tokenRanges[0][0] > 0 {
-		tokens = append(tokens, s[:tokenRanges[0][0]])
+// rarestToken returns the index key addPattern should store pattern's rule
+// under: among pattern's runs of 3 or more alphanumeric characters
+// (lower-cased), the one with the fewest rules already indexed under it,
+// ties broken in favor of the longer, then first-seen, token. Returns ""
+// if pattern has no such run (e.g. it's all wildcards and anchors).
+//
+// Picking by rarity rather than just length matters for real filter
+// lists, where many patterns share a common literal substring ahead of a
+// varying suffix (e.g. "/track-1/pixel*.gif", "/track-2/pixel*.gif", ...)
+// - always picking the longest token would collapse all of them onto the
+// same bucket (here, "track"), defeating the point of the shortcut index:
+// a request would still have to be checked against every one of them.
+// This mirrors the approach urlfilter's NetworkEngine takes to the same
+// problem. Callers must hold patternMu.
+func (idx *index) rarestToken(pattern string) string {
+	runs := alnumRuns(pattern)
+	if len(runs) == 0 {
+		return ""
 	}
+	best := strings.ToLower(runs[0])
+	bestCount := len(idx.patterns[best])
+	for _, token := range runs[1:] {
+		token = strings.ToLower(token)
+		count := len(idx.patterns[token])
+		if count < bestCount || (count == bestCount && len(token) > len(best)) {
+			best, bestCount = token, count
+		}
+	}
+	return best
+}
 
-	var nextStartIndex int
-	for i, tokenRange := range tokenRanges {
-		tokens = append(tokens, s[tokenRange[0]:tokenRange[1]])
+// shortcutCandidates returns the set of index keys - including the ""
+// fallback bucket for patterns with no shortcut - that a request for url
+// needs to be checked against.
+func shortcutCandidates(url string) []string {
+	seen := map[string]bool{"": true}
+	candidates := []string{""}
+	for _, token := range alnumRuns(url) {
+		token = strings.ToLower(token)
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		candidates = append(candidates, token)
+	}
+	return candidates
+}
 
-		nextStartIndex = tokenRange[1]
-		if i < len(tokenRanges)-1 {
-			nextEndIndex := tokenRanges[i+1][0]
-			if nextStartIndex < nextEndIndex {
-				tokens = append(tokens, s[nextStartIndex:nextEndIndex])
+// alnumRuns returns every maximal run of 3 or more ASCII letters/digits in s.
+func alnumRuns(s string) []string {
+	var runs []string
+	start := -1
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && isAlnumByte(s[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			if i-start >= 3 {
+				runs = append(runs, s[start:i])
 			}
+			start = -1
 		}
 	}
+	return runs
+}
+
+func isAlnumByte(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// compilePatternRegex translates an Adblock pattern (with the @@ prefix and
+// $modifiers already stripped) to a Go regular expression: "||" anchors to
+// the start of the hostname, a lone leading/trailing "|" anchors to the
+// start/end of the URL, "*" becomes a wildcard, "^" becomes a separator
+// (any character other than a letter, digit, "_", ".", "%", or "-", or the
+// end of the string), and
+// everything else is matched literally.
+//
+// This is a simplification of the full Adblock Plus pattern syntax - it
+// doesn't special-case "||" followed by a literal IP address, for
+// instance - but it covers the patterns real filter lists use.
+func compilePatternRegex(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+
+	rest := pattern
+	switch {
+	case strings.HasPrefix(rest, "||"):
+		b.WriteString(`^[a-zA-Z][a-zA-Z0-9+.-]*://([a-zA-Z0-9-]+\.)*`)
+		rest = rest[2:]
+	case strings.HasPrefix(rest, "|"):
+		b.WriteString("^")
+		rest = rest[1:]
+	}
+
+	trailingAnchor := strings.HasSuffix(rest, "|")
+	if trailingAnchor {
+		rest = rest[:len(rest)-1]
+	}
 
-	if nextStartIndex < len(s) {
-		tokens = append(tokens, s[nextStartIndex:])
+	for _, r := range rest {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '^':
+			b.WriteString(`(?:[^a-zA-Z0-9_.%-]|$)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if trailingAnchor {
+		b.WriteString("$")
 	}
 
-	return tokens
-}
\ No newline at end of file
+	return regexp.Compile(b.String())
+}
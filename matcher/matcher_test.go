@@ -0,0 +1,252 @@
+package matcher
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMatchHostname(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^")
+
+	tests := []struct {
+		url  string
+		want Action
+	}{
+		{"https://ads.example.com/banner.js", Block},
+		{"https://sub.ads.example.com/banner.js", Block},
+		{"https://example.com/page", NoMatch},
+		{"https://notads.example.com/page", NoMatch},
+	}
+	for _, tt := range tests {
+		if got := m.Match(&Request{URL: tt.url}); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHostsFile(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("0.0.0.0 tracker.example.com")
+	m.AddRule("127.0.0.1 localhost")
+
+	if got := m.Match(&Request{URL: "https://tracker.example.com/"}); got != Block {
+		t.Errorf("Match(tracker.example.com) = %v, want Block", got)
+	}
+	if got := m.Match(&Request{URL: "https://localhost/"}); got != NoMatch {
+		t.Errorf("Match(localhost) = %v, want NoMatch (ignored hosts-file entry)", got)
+	}
+}
+
+func TestMatchWildcardHostname(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||*.example.com^")
+
+	if got := m.Match(&Request{URL: "https://example.com/"}); got != NoMatch {
+		t.Errorf("Match(apex) = %v, want NoMatch", got)
+	}
+	if got := m.Match(&Request{URL: "https://sub.example.com/"}); got != Block {
+		t.Errorf("Match(subdomain) = %v, want Block", got)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("/banner-ad*.js")
+	m.AddRule("|https://exact.example.com/x|")
+
+	if got := m.Match(&Request{URL: "https://cdn.example.com/banner-ad-300x250.js"}); got != Block {
+		t.Errorf("wildcard pattern: got %v, want Block", got)
+	}
+	if got := m.Match(&Request{URL: "https://cdn.example.com/other.js"}); got != NoMatch {
+		t.Errorf("wildcard pattern on non-matching URL: got %v, want NoMatch", got)
+	}
+	if got := m.Match(&Request{URL: "https://exact.example.com/x"}); got != Block {
+		t.Errorf("exact-address pattern: got %v, want Block", got)
+	}
+	if got := m.Match(&Request{URL: "https://exact.example.com/x?y"}); got != NoMatch {
+		t.Errorf("exact-address pattern with trailing anchor: got %v, want NoMatch", got)
+	}
+}
+
+func TestMatchExceptionPrecedence(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^")
+	m.AddRule("@@||ads.example.com/allowed.js")
+
+	if got := m.Match(&Request{URL: "https://ads.example.com/banner.js"}); got != Block {
+		t.Errorf("plain request: got %v, want Block", got)
+	}
+	if got := m.Match(&Request{URL: "https://ads.example.com/allowed.js"}); got != Allow {
+		t.Errorf("excepted request: got %v, want Allow", got)
+	}
+}
+
+func TestMatchDocumentException(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^")
+	m.AddRule("@@||example.com^$document")
+
+	// A subresource request whose initiator document is on the
+	// $document-exempted site is allowed, even though the request itself
+	// targets a different, normally-blocked host.
+	req := &Request{URL: "https://ads.example.com/banner.js", SourceURL: "https://example.com/page"}
+	if got := m.Match(req); got != Allow {
+		t.Errorf("Match = %v, want Allow ($document exception on initiator)", got)
+	}
+
+	// The same request without a whitelisted initiator is still blocked.
+	req.SourceURL = "https://other.com/page"
+	if got := m.Match(req); got != Block {
+		t.Errorf("Match = %v, want Block (initiator not exempted)", got)
+	}
+}
+
+func TestMatchImportantOverridesException(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("@@||example.com^")
+	m.AddRule("||example.com^$important")
+
+	if got := m.Match(&Request{URL: "https://example.com/"}); got != Block {
+		t.Errorf("got %v, want Block (important beats exception)", got)
+	}
+}
+
+func TestMatchModifiers(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^$domain=allowed.com,method=get")
+
+	blockedReq := &Request{URL: "https://ads.example.com/x", SourceURL: "https://allowed.com/", Method: "GET"}
+	if got := m.Match(blockedReq); got != Block {
+		t.Errorf("matching domain+method: got %v, want Block", got)
+	}
+
+	wrongDomain := &Request{URL: "https://ads.example.com/x", SourceURL: "https://other.com/", Method: "GET"}
+	if got := m.Match(wrongDomain); got != NoMatch {
+		t.Errorf("non-matching domain: got %v, want NoMatch", got)
+	}
+
+	wrongMethod := &Request{URL: "https://ads.example.com/x", SourceURL: "https://allowed.com/", Method: "POST"}
+	if got := m.Match(wrongMethod); got != NoMatch {
+		t.Errorf("non-matching method: got %v, want NoMatch", got)
+	}
+}
+
+func TestMatchCSP(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^$csp=script-src 'self'")
+
+	// A csp= rule never blocks the request.
+	if got := m.Match(&Request{URL: "https://ads.example.com/x"}); got != NoMatch {
+		t.Errorf("Match = %v, want NoMatch (csp= never blocks)", got)
+	}
+	if got := m.MatchCSP(&Request{URL: "https://ads.example.com/x"}); len(got) != 1 || got[0] != "script-src 'self'" {
+		t.Errorf("MatchCSP = %v, want [\"script-src 'self'\"]", got)
+	}
+
+	m.AddRule("@@||ads.example.com^$csp=script-src 'self'")
+	if got := m.MatchCSP(&Request{URL: "https://ads.example.com/x"}); got != nil {
+		t.Errorf("MatchCSP = %v, want nil (csp= exception disables injection)", got)
+	}
+}
+
+func TestMatchDNS(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^$dnsrewrite=NOERROR;A;1.2.3.4")
+	m.AddRule("||track.example.net^$dnsrewrite=NXDOMAIN")
+	m.AddRule("||*.wild.example.org^")
+	m.AddRule("@@||allowed.example.com^")
+	m.AddRule("||allowed.example.com^$important")
+	m.AddRule("||onlyaaaa.example^$dnstype=AAAA")
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		want  DNSAction
+	}{
+		{"rewrite", "sub.ads.example.com", DNSTypeA, DNSAction{Action: Block, RewriteType: "A", RewriteValue: "1.2.3.4"}},
+		{"nxdomain shorthand", "track.example.net", DNSTypeA, DNSAction{Action: Block, NXDomain: true}},
+		{"wildcard subdomain", "leaf.wild.example.org", DNSTypeA, DNSAction{Action: Block}},
+		{"wildcard apex excluded", "wild.example.org", DNSTypeA, DNSAction{Action: NoMatch}},
+		{"important beats exception", "allowed.example.com", DNSTypeA, DNSAction{Action: Block}},
+		{"dnstype excludes other types", "onlyaaaa.example", DNSTypeA, DNSAction{Action: NoMatch}},
+		{"dnstype matches its type", "onlyaaaa.example", DNSTypeAAAA, DNSAction{Action: Block}},
+		{"no match", "nothing.example", DNSTypeA, DNSAction{Action: NoMatch}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.MatchDNS(tt.qname, tt.qtype); got != tt.want {
+				t.Errorf("MatchDNS(%q, %d) = %+v, want %+v", tt.qname, tt.qtype, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParentDomain(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"a.b.com", "b.com"},
+		{"b.com", "com"},
+		{"com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := parentDomain(tt.host); got != tt.want {
+			t.Errorf("parentDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRarestTokenSpreadsSharedPrefixAcrossBuckets(t *testing.T) {
+	idx := newIndex()
+	for i := 0; i < 100; i++ {
+		// Every pattern shares the literal "track", which is also always
+		// the longest alphanumeric run - the case that used to collapse
+		// all of them onto the same bucket.
+		idx.addPattern(fmt.Sprintf("/track-%d/pixel*.gif", i), nil, false)
+	}
+
+	idx.patternMu.RLock()
+	defer idx.patternMu.RUnlock()
+	if got := len(idx.patterns["track"]); got >= 100 {
+		t.Errorf(`patterns["track"] has %d rules, want it spread across more than one bucket`, got)
+	}
+	if len(idx.patterns) < 2 {
+		t.Errorf("got %d buckets, want patterns spread across more than one", len(idx.patterns))
+	}
+}
+
+// benchmarkCorpus builds a Matcher with a synthetic rule set sized and
+// shaped like a real-world list such as EasyList+EasyPrivacy: mostly
+// hostname rules, with a smaller share of pattern rules carrying
+// modifiers.
+func benchmarkCorpus(b *testing.B) *Matcher {
+	b.Helper()
+	m := NewMatcher()
+	for i := 0; i < 80000; i++ {
+		m.AddRule(fmt.Sprintf("||ad%d.example.com^", i))
+	}
+	for i := 0; i < 20000; i++ {
+		m.AddRule(fmt.Sprintf("/track-%d/pixel*.gif$domain=example.com", i))
+	}
+	return m
+}
+
+// BenchmarkMatchCacheHit measures Match against a request that repeatedly
+// hits the same hostname entry, i.e. the steady-state cost once the
+// relevant bucket is warm in CPU cache. As of this benchmark's last run,
+// that's a few microseconds per call on the corpus above, not the
+// sub-microsecond stretch goal this index was originally framed around -
+// most of the cost is the pattern index's per-request bucket lookups
+// (one per alphanumeric run in the URL), not the hostname walk.
+func BenchmarkMatchCacheHit(b *testing.B) {
+	m := benchmarkCorpus(b)
+	req := &Request{URL: "https://ad42.example.com/banner.js", SourceURL: "https://example.com/"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match(req)
+	}
+}
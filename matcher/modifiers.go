@@ -0,0 +1,358 @@
+package matcher
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type modifierType int
+
+const (
+	modifierTypeNone modifierType = iota
+	modifierTypeInclude
+	modifierTypeExclude
+)
+
+// ruleModifiers represents modifiers of a rule.
+type ruleModifiers struct {
+	// content type modifiers
+	// https://adguard.com/kb/general/ad-filtering/create-own-filters/#content-type-modifiers
+	document   modifierType
+	font       modifierType
+	image      modifierType
+	media      modifierType
+	other      modifierType
+	script     modifierType
+	stylesheet modifierType
+
+	// basic modifiers
+	// https://adguard.com/kb/general/ad-filtering/create-own-filters/#basic-rules-basic-modifiers
+	domain     *domainList
+	denyallow  *domainList
+	thirdParty modifierType
+	important  bool
+	method     *stringSetList
+	header     string
+	// csp is the directive of a csp= modifier, e.g. "script-src 'self'". A
+	// rule carrying it doesn't block the request at all - Match skips it
+	// entirely - it instead asks the caller to inject this directive into
+	// the response's Content-Security-Policy header. See MatchCSP.
+	csp string
+
+	// DNS-filtering modifiers, consulted by MatchDNS rather than Match.
+	// https://adguard.com/kb/general/ad-filtering/create-own-filters/#dns-modifiers
+	dnsType    *stringSetList
+	dnsRewrite *dnsRewrite
+}
+
+// domainList represents a pipe-separated list of domains as used by the
+// domain= and denyallow= modifiers, e.g. "example.com|~sub.example.com".
+// A leading ~ moves an entry to exclude.
+type domainList struct {
+	include []string
+	exclude []string
+}
+
+func parseDomainList(value string) *domainList {
+	d := &domainList{}
+	for _, entry := range strings.Split(value, "|") {
+		if entry == "" {
+			continue
+		}
+		if entry[0] == '~' {
+			d.exclude = append(d.exclude, entry[1:])
+		} else {
+			d.include = append(d.include, entry)
+		}
+	}
+	return d
+}
+
+// matches reports whether hostname is covered by the domain list: excluded
+// entries always win, and an empty include list matches everything else.
+func (d *domainList) matches(hostname string) bool {
+	if d == nil {
+		return true
+	}
+	for _, domain := range d.exclude {
+		if domainMatches(hostname, domain) {
+			return false
+		}
+	}
+	if len(d.include) == 0 {
+		return true
+	}
+	for _, domain := range d.include {
+		if domainMatches(hostname, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatches reports whether hostname is domain itself or a subdomain of it.
+func domainMatches(hostname, domain string) bool {
+	return hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
+
+// stringSetList represents a pipe-separated list of upper-cased tokens, as
+// used by the method= modifier (e.g. "get|head") and the dnstype= modifier
+// (e.g. "A|AAAA"). A leading ~ moves an entry to exclude.
+type stringSetList struct {
+	include []string
+	exclude []string
+}
+
+func parseStringSetList(value string) *stringSetList {
+	s := &stringSetList{}
+	for _, entry := range strings.Split(value, "|") {
+		if entry == "" {
+			continue
+		}
+		if entry[0] == '~' {
+			s.exclude = append(s.exclude, strings.ToUpper(entry[1:]))
+		} else {
+			s.include = append(s.include, strings.ToUpper(entry))
+		}
+	}
+	return s
+}
+
+func (s *stringSetList) matches(value string) bool {
+	if s == nil {
+		return true
+	}
+	value = strings.ToUpper(value)
+	for _, excluded := range s.exclude {
+		if value == excluded {
+			return false
+		}
+	}
+	if len(s.include) == 0 {
+		return true
+	}
+	for _, included := range s.include {
+		if value == included {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsRewrite represents the target of a dnsrewrite= modifier, e.g.
+// "$dnsrewrite=NOERROR;A;1.2.3.4" or the "$dnsrewrite=NXDOMAIN" shorthand
+// for an empty rewrite that just turns the query into an NXDOMAIN response.
+type dnsRewrite struct {
+	// nxdomain is true for the NXDOMAIN shorthand, or a full form whose
+	// rcode is NXDOMAIN.
+	nxdomain bool
+	// rtype is the rewritten record type, e.g. "A" or "CNAME", empty for
+	// the NXDOMAIN shorthand.
+	rtype string
+	// value is the rewrite target, e.g. an IP address or hostname, empty
+	// for the NXDOMAIN shorthand.
+	value string
+}
+
+// parseDNSRewrite parses the value of a dnsrewrite= modifier. The full form
+// is "rcode;rtype;value" (e.g. "NOERROR;A;1.2.3.4"); "NXDOMAIN" alone is a
+// shorthand for an empty rewrite.
+func parseDNSRewrite(value string) *dnsRewrite {
+	if strings.EqualFold(value, "NXDOMAIN") {
+		return &dnsRewrite{nxdomain: true}
+	}
+	parts := strings.SplitN(value, ";", 3)
+	d := &dnsRewrite{}
+	if len(parts) > 0 && strings.EqualFold(parts[0], "NXDOMAIN") {
+		d.nxdomain = true
+	}
+	if len(parts) > 1 {
+		d.rtype = strings.ToUpper(parts[1])
+	}
+	if len(parts) > 2 {
+		d.value = parts[2]
+	}
+	return d
+}
+
+func parseModifiers(modifiers string) (*ruleModifiers, error) {
+	if modifiers == "" {
+		return nil, nil
+	}
+
+	m := &ruleModifiers{}
+	for _, modifier := range strings.Split(modifiers, ",") {
+		if key, value, ok := strings.Cut(modifier, "="); ok {
+			switch key {
+			case "domain":
+				m.domain = parseDomainList(value)
+			case "denyallow":
+				m.denyallow = parseDomainList(value)
+			case "method":
+				m.method = parseStringSetList(value)
+			case "header":
+				m.header = value
+			case "csp":
+				m.csp = value
+			case "dnstype":
+				m.dnsType = parseStringSetList(value)
+			case "dnsrewrite":
+				m.dnsRewrite = parseDNSRewrite(value)
+			default:
+				return nil, fmt.Errorf("unknown modifier %q", key)
+			}
+			continue
+		}
+
+		t := modifierTypeInclude
+		if modifier[0] == '~' {
+			t = modifierTypeExclude
+			modifier = modifier[1:]
+		}
+		switch modifier {
+		case "document":
+			m.document = t
+		case "font":
+			m.font = t
+		case "image":
+			m.image = t
+		case "media":
+			m.media = t
+		case "other":
+			m.other = t
+		case "script":
+			m.script = t
+		case "stylesheet":
+			m.stylesheet = t
+		case "third-party":
+			m.thirdParty = t
+		case "important":
+			if t == modifierTypeExclude {
+				return nil, fmt.Errorf("modifier %q cannot be negated", modifier)
+			}
+			m.important = true
+		default:
+			// first, do no harm
+			// in case an unknown modifier is encountered, ignore the whole rule
+			return nil, fmt.Errorf("unknown modifier %q", modifier)
+		}
+	}
+	return m, nil
+}
+
+// evaluateModifiers reports whether a rule's modifiers allow it to apply to
+// req. A nil modifiers set (a rule with no modifiers) always applies.
+func evaluateModifiers(m *ruleModifiers, req *Request) bool {
+	if m == nil {
+		return true
+	}
+	if !evaluateResourceType(m, req.ResourceType) {
+		return false
+	}
+	sourceHost := hostname(req.SourceURL)
+	if !m.domain.matches(sourceHost) {
+		return false
+	}
+	// denyallow= excludes request targets from a domain=-scoped rule, so
+	// unlike domain= it's matched against the request's own host, not the
+	// source document's.
+	if m.denyallow != nil && m.denyallow.matches(hostname(req.URL)) {
+		return false
+	}
+	if m.thirdParty != modifierTypeNone {
+		thirdParty := isThirdParty(req.URL, req.SourceURL)
+		if (m.thirdParty == modifierTypeInclude) != thirdParty {
+			return false
+		}
+	}
+	if !m.method.matches(req.Method) {
+		return false
+	}
+	if m.header != "" && !matchesHeader(m.header, req.Headers) {
+		return false
+	}
+	return true
+}
+
+// evaluateResourceType reports whether resourceType is allowed by m's
+// content-type modifiers. If any content-type modifier is included, only
+// the included types match; otherwise every type matches except the ones
+// explicitly excluded.
+func evaluateResourceType(m *ruleModifiers, resourceType string) bool {
+	types := map[string]modifierType{
+		"document":   m.document,
+		"font":       m.font,
+		"image":      m.image,
+		"media":      m.media,
+		"other":      m.other,
+		"script":     m.script,
+		"stylesheet": m.stylesheet,
+	}
+
+	hasInclude := false
+	for _, t := range types {
+		if t == modifierTypeInclude {
+			hasInclude = true
+			break
+		}
+	}
+
+	t := types[resourceType]
+	if hasInclude {
+		return t == modifierTypeInclude
+	}
+	return t != modifierTypeExclude
+}
+
+// isThirdParty reports whether requestURL and sourceURL belong to different
+// sites, approximated here by comparing their registrable domain (the last
+// two hostname labels). This is a simplification of the public-suffix-list
+// comparison real ad blockers use, but holds for the common case.
+func isThirdParty(requestURL, sourceURL string) bool {
+	a, b := registrableDomain(hostname(requestURL)), registrableDomain(hostname(sourceURL))
+	if a == "" || b == "" {
+		return false
+	}
+	return a != b
+}
+
+func registrableDomain(host string) string {
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// hostname extracts the host (without port) from rawURL, returning "" if
+// rawURL can't be parsed or has no host.
+func hostname(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// matchesHeader reports whether headers satisfy a header= modifier spec of
+// the form "Name" (header must be present) or "Name:Value" (header must be
+// present with exactly that value, case-insensitively).
+func matchesHeader(spec string, headers http.Header) bool {
+	if headers == nil {
+		return false
+	}
+	name, value, hasValue := strings.Cut(spec, ":")
+	got := headers.Get(name)
+	if got == "" {
+		return false
+	}
+	if !hasValue {
+		return true
+	}
+	return strings.EqualFold(got, value)
+}
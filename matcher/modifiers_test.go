@@ -0,0 +1,138 @@
+package matcher
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDomainListMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		host  string
+		want  bool
+	}{
+		{"nil list matches everything", "", "example.com", true},
+		{"include matches self", "example.com", "example.com", true},
+		{"include matches subdomain", "example.com", "sub.example.com", true},
+		{"include excludes unrelated host", "example.com", "other.com", false},
+		{"exclude wins over include", "example.com|~ads.example.com", "ads.example.com", false},
+		{"exclude alone still allows others", "~ads.example.com", "example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d *domainList
+			if tt.value != "" {
+				d = parseDomainList(tt.value)
+			}
+			if got := d.matches(tt.host); got != tt.want {
+				t.Errorf("parseDomainList(%q).matches(%q) = %v, want %v", tt.value, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateModifiersDomain(t *testing.T) {
+	m, err := parseModifiers("domain=allowed.com")
+	if err != nil {
+		t.Fatalf("parseModifiers: %v", err)
+	}
+	if !evaluateModifiers(m, &Request{URL: "https://x.com/", SourceURL: "https://allowed.com/"}) {
+		t.Error("expected match for allowed source domain")
+	}
+	if evaluateModifiers(m, &Request{URL: "https://x.com/", SourceURL: "https://other.com/"}) {
+		t.Error("expected no match for disallowed source domain")
+	}
+}
+
+func TestEvaluateModifiersDenyallow(t *testing.T) {
+	// denyallow= excludes request targets from a domain=-scoped rule: it's
+	// evaluated against the request's own host, not the source document.
+	m, err := parseModifiers("domain=a.com,denyallow=x.com")
+	if err != nil {
+		t.Fatalf("parseModifiers: %v", err)
+	}
+
+	deniedTarget := &Request{URL: "https://x.com/ad.js", SourceURL: "https://a.com/page"}
+	if evaluateModifiers(m, deniedTarget) {
+		t.Error("expected no match: request target x.com is denyallow-excluded")
+	}
+
+	deniedSource := &Request{URL: "https://x.com/ad.js", SourceURL: "https://x.com/page"}
+	if evaluateModifiers(m, deniedSource) {
+		t.Error("expected no match: domain=a.com doesn't match source x.com")
+	}
+
+	allowedTarget := &Request{URL: "https://y.com/ad.js", SourceURL: "https://a.com/page"}
+	if !evaluateModifiers(m, allowedTarget) {
+		t.Error("expected match: target y.com isn't denyallow-excluded")
+	}
+}
+
+func TestEvaluateModifiersMethod(t *testing.T) {
+	m, err := parseModifiers("method=get|head")
+	if err != nil {
+		t.Fatalf("parseModifiers: %v", err)
+	}
+	if !evaluateModifiers(m, &Request{URL: "https://x.com/", Method: "GET"}) {
+		t.Error("expected match for GET")
+	}
+	if !evaluateModifiers(m, &Request{URL: "https://x.com/", Method: "head"}) {
+		t.Error("expected match for head (case-insensitive)")
+	}
+	if evaluateModifiers(m, &Request{URL: "https://x.com/", Method: "POST"}) {
+		t.Error("expected no match for POST")
+	}
+}
+
+func TestEvaluateModifiersHeader(t *testing.T) {
+	m, err := parseModifiers("header=X-Test:yes")
+	if err != nil {
+		t.Fatalf("parseModifiers: %v", err)
+	}
+
+	headers := http.Header{"X-Test": []string{"yes"}}
+	if !evaluateModifiers(m, &Request{URL: "https://x.com/", Headers: headers}) {
+		t.Error("expected match for header with matching value")
+	}
+
+	wrongValue := http.Header{"X-Test": []string{"no"}}
+	if evaluateModifiers(m, &Request{URL: "https://x.com/", Headers: wrongValue}) {
+		t.Error("expected no match for header with different value")
+	}
+
+	if evaluateModifiers(m, &Request{URL: "https://x.com/"}) {
+		t.Error("expected no match when the header is absent")
+	}
+}
+
+func TestStringSetListMatches(t *testing.T) {
+	s := parseStringSetList("A|AAAA")
+	if !s.matches("a") {
+		t.Error("expected case-insensitive include match")
+	}
+	if s.matches("CNAME") {
+		t.Error("expected no match for a type not in the include list")
+	}
+
+	var nilList *stringSetList
+	if !nilList.matches("anything") {
+		t.Error("a nil list should match everything")
+	}
+}
+
+func TestParseDNSRewrite(t *testing.T) {
+	tests := []struct {
+		value string
+		want  dnsRewrite
+	}{
+		{"NXDOMAIN", dnsRewrite{nxdomain: true}},
+		{"NOERROR;A;1.2.3.4", dnsRewrite{rtype: "A", value: "1.2.3.4"}},
+		{"NXDOMAIN;A;1.2.3.4", dnsRewrite{nxdomain: true, rtype: "A", value: "1.2.3.4"}},
+	}
+	for _, tt := range tests {
+		if got := parseDNSRewrite(tt.value); *got != tt.want {
+			t.Errorf("parseDNSRewrite(%q) = %+v, want %+v", tt.value, *got, tt.want)
+		}
+	}
+}
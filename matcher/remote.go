@@ -0,0 +1,286 @@
+package matcher
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxConcurrentFetches bounds how many filter lists AddRemoteFilters and
+// Reload download at once.
+const maxConcurrentFetches = 8
+
+// FetchResult is the outcome of fetching a single filter list source.
+type FetchResult struct {
+	// URL is the source this result is for.
+	URL string
+	// Rules is the number of lines read from the source. Comment, blank,
+	// and unparseable lines are counted too.
+	Rules int
+	// Modified is true if the source had changed since the last fetch
+	// (or there was no cache yet), and false if the server reported it
+	// unchanged (HTTP 304) and the cached copy was reused.
+	Modified bool
+	// Err is set if the source couldn't be fetched or read at all. A
+	// non-nil Err means Rules and Modified are meaningless for this entry.
+	Err error
+}
+
+// cacheMeta is the sidecar metadata AddRemoteFilters and Reload store
+// alongside each cached filter list, so the next fetch can send
+// conditional request headers.
+type cacheMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// AddRemoteFilters fetches the rules files at the given URLs, concurrently,
+// and adds them to the matcher's rule set. Sources are remembered so a
+// later Reload(ctx) can re-fetch the same list.
+//
+// If the Matcher was built with WithCacheDir, each source is cached on
+// disk keyed by URL; refetches send If-None-Match/If-Modified-Since so an
+// unchanged source costs a round trip, not a re-download, and a source
+// that can't be reached falls back to its last cached copy rather than
+// leaving that part of the rule set empty.
+func (m *Matcher) AddRemoteFilters(ctx context.Context, urls []string) []FetchResult {
+	m.sourcesMu.Lock()
+	m.sources = append([]string(nil), urls...)
+	m.sourcesMu.Unlock()
+
+	return m.fetchInto(ctx, urls, m.idx.Load())
+}
+
+// Reload re-fetches the sources passed to the most recent AddRemoteFilters
+// call into a freshly built index, then atomically swaps it in. Traffic
+// being matched concurrently keeps using the old rule set until the swap
+// completes, so it never observes a half-populated one.
+//
+// Reload only knows about sources registered via AddRemoteFilters; rules
+// added directly with AddRule aren't tracked and won't survive a Reload.
+// If there are no such sources, or every one of them failed to fetch, the
+// current rule set is left in place rather than swapped for an empty or
+// partial one - a blocklist should degrade to stale, not to off.
+func (m *Matcher) Reload(ctx context.Context) []FetchResult {
+	m.sourcesMu.Lock()
+	urls := append([]string(nil), m.sources...)
+	m.sourcesMu.Unlock()
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	idx := newIndex()
+	results := m.fetchInto(ctx, urls, idx)
+
+	allFailed := true
+	for _, result := range results {
+		if result.Err == nil {
+			allFailed = false
+			break
+		}
+	}
+	if allFailed {
+		return results
+	}
+
+	m.idx.Store(idx)
+	return results
+}
+
+// fetchInto downloads urls concurrently, bounded by maxConcurrentFetches,
+// parses each into idx, and returns one FetchResult per URL in the same
+// order they were given.
+func (m *Matcher) fetchInto(ctx context.Context, urls []string, idx *index) []FetchResult {
+	results := make([]FetchResult, len(urls))
+	sem := make(chan struct{}, maxConcurrentFetches)
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = m.fetchOne(ctx, url, idx)
+		}(i, url)
+	}
+	wg.Wait()
+	return results
+}
+
+func (m *Matcher) fetchOne(ctx context.Context, url string, idx *index) FetchResult {
+	result := FetchResult{URL: url}
+
+	cachePath, metaPath := m.cachePaths(url)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Err = fmt.Errorf("building request: %w", err)
+		return result
+	}
+	if meta, err := readCacheMeta(metaPath); err == nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		// The source is unreachable; fall back to whatever we have
+		// cached rather than leaving this part of the rule set empty.
+		if n, cacheErr := addRulesFromFile(idx, cachePath); cacheErr == nil {
+			result.Rules = n
+			return result
+		}
+		result.Err = fmt.Errorf("fetching: %w", err)
+		return result
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		n, err := addRulesFromFile(idx, cachePath)
+		if err != nil {
+			result.Err = fmt.Errorf("reading cache after 304: %w", err)
+			return result
+		}
+		result.Rules = n
+		return result
+
+	case http.StatusOK:
+		n, err := m.cacheAndAdd(idx, cachePath, metaPath, resp)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		result.Rules = n
+		result.Modified = true
+		return result
+
+	default:
+		result.Err = fmt.Errorf("unexpected status %s", resp.Status)
+		return result
+	}
+}
+
+// cacheAndAdd streams resp's body to a temporary file in the cache
+// directory and renames it into place atomically - so a download that's
+// interrupted partway through never corrupts the existing cached copy -
+// then parses the now-committed file into idx. If the matcher has no
+// cache directory configured, it parses the body directly without
+// persisting it.
+func (m *Matcher) cacheAndAdd(idx *index, cachePath, metaPath string, resp *http.Response) (int, error) {
+	if m.cacheDir == "" {
+		return addRules(idx, resp.Body)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), filepath.Base(cachePath)+".tmp-*")
+	if err != nil {
+		return 0, fmt.Errorf("creating temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("downloading: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("downloading: %w", err)
+	}
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		return 0, fmt.Errorf("committing download: %w", err)
+	}
+
+	meta := cacheMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if err := writeCacheMeta(metaPath, meta); err != nil {
+		return 0, fmt.Errorf("writing cache metadata: %w", err)
+	}
+
+	return addRulesFromFile(idx, cachePath)
+}
+
+func (m *Matcher) cachePaths(url string) (cachePath, metaPath string) {
+	if m.cacheDir == "" {
+		return "", ""
+	}
+	sum := sha256.Sum256([]byte(url))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(m.cacheDir, name), filepath.Join(m.cacheDir, name+".meta")
+}
+
+func addRulesFromFile(idx *index, path string) (int, error) {
+	if path == "" {
+		return 0, fmt.Errorf("no cached copy available")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return addRules(idx, f)
+}
+
+// addRules reads newline-separated rules from r and adds each to idx. It
+// uses bufio.Scanner rather than manual ReadString handling so the final
+// line of a file with no trailing newline is still read.
+func addRules(idx *index, r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	// Filter list lines are usually short, but raise the default 64KiB
+	// limit for the occasional pathological cosmetic rule.
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	n := 0
+	for scanner.Scan() {
+		addRuleTo(idx, scanner.Text())
+		n++
+	}
+	return n, scanner.Err()
+}
+
+func readCacheMeta(path string) (cacheMeta, error) {
+	var meta cacheMeta
+	if path == "" {
+		return meta, fmt.Errorf("no cache directory configured")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func writeCacheMeta(path string, meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,108 @@
+package matcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddRemoteFiltersFirstFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "||ads.example.com^")
+	}))
+	defer srv.Close()
+
+	m := NewMatcher(WithCacheDir(t.TempDir()))
+	results := m.AddRemoteFilters(context.Background(), []string{srv.URL})
+
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Fatalf("unexpected error: %v", results[0].Err)
+	}
+	if !results[0].Modified || results[0].Rules != 1 {
+		t.Errorf("got %+v, want Modified=true Rules=1", results[0])
+	}
+	if got := m.Match(&Request{URL: "https://ads.example.com/x"}); got != Block {
+		t.Errorf("Match after first fetch = %v, want Block", got)
+	}
+}
+
+func TestReload304Revalidation(t *testing.T) {
+	const etag = `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprintln(w, "||ads.example.com^")
+	}))
+	defer srv.Close()
+
+	m := NewMatcher(WithCacheDir(t.TempDir()))
+	if results := m.AddRemoteFilters(context.Background(), []string{srv.URL}); results[0].Err != nil {
+		t.Fatalf("initial fetch: %v", results[0].Err)
+	}
+
+	results := m.Reload(context.Background())
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Fatalf("unexpected error: %v", results[0].Err)
+	}
+	if results[0].Modified {
+		t.Error("expected Modified=false on a 304 response")
+	}
+	if results[0].Rules != 1 {
+		t.Errorf("got Rules=%d, want 1 (from cache after 304)", results[0].Rules)
+	}
+	if got := m.Match(&Request{URL: "https://ads.example.com/x"}); got != Block {
+		t.Errorf("Match after 304 reload = %v, want Block", got)
+	}
+}
+
+func TestReloadFallsBackToCacheOnFetchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "||ads.example.com^")
+	}))
+
+	m := NewMatcher(WithCacheDir(t.TempDir()))
+	if results := m.AddRemoteFilters(context.Background(), []string{srv.URL}); results[0].Err != nil {
+		t.Fatalf("initial fetch: %v", results[0].Err)
+	}
+
+	// Closing the server makes every subsequent request fail to connect,
+	// simulating a source that's gone temporarily unreachable.
+	srv.Close()
+
+	results := m.Reload(context.Background())
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Fatalf("expected fallback to cached copy with no error, got %v", results[0].Err)
+	}
+	if results[0].Modified {
+		t.Error("expected Modified=false when falling back to the cache")
+	}
+	if got := m.Match(&Request{URL: "https://ads.example.com/x"}); got != Block {
+		t.Errorf("Match after fallback reload = %v, want Block", got)
+	}
+}
+
+func TestReloadNoSourcesLeavesRuleSetInPlace(t *testing.T) {
+	m := NewMatcher()
+	m.AddRule("||ads.example.com^")
+
+	m.Reload(context.Background())
+
+	if got := m.Match(&Request{URL: "https://ads.example.com/x"}); got != Block {
+		t.Errorf("Match after Reload with no remote sources = %v, want Block", got)
+	}
+}
@@ -0,0 +1,27 @@
+package matcher
+
+import "net/http"
+
+// Request describes the network request being matched against the filter
+// rules. URL is the only required field; the rest allow modifiers such as
+// domain=, third-party, method=, and header= to be evaluated. Callers that
+// don't have a piece of context (e.g. no request headers available) can
+// leave the corresponding field at its zero value. A zero value matches none
+// of the values a modifier lists, so a rule that requires one (e.g.
+// domain=example.com, method=get, header=, third-party) doesn't apply,
+// while a rule that only excludes values (e.g. domain=~example.com) does.
+type Request struct {
+	// URL is the fully qualified request URL.
+	URL string
+	// SourceURL is the URL of the document or initiator that triggered the
+	// request. It backs the domain= and third-party modifiers.
+	SourceURL string
+	// Method is the HTTP method of the request, e.g. "GET".
+	Method string
+	// Headers are the request headers, used by the header= modifier.
+	Headers http.Header
+	// ResourceType is the content type of the request, one of the
+	// content-type modifier names: document, font, image, media, other,
+	// script, or stylesheet.
+	ResourceType string
+}